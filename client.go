@@ -0,0 +1,329 @@
+package icapclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultOptionsTTL is the lifetime given to a cached OptionsResponse
+// when the server does not advertise its own Options-TTL.
+const DefaultOptionsTTL = 5 * time.Minute
+
+// Client is an ICAP client that sends Request values to an ICAP server
+// and parses the raw wire response. The zero value is not usable; create
+// one with NewClient.
+type Client struct {
+	mu      sync.Mutex
+	options map[string]*cachedOptions
+}
+
+type cachedOptions struct {
+	resp      *OptionsResponse
+	fetchedAt time.Time
+	ttl       time.Duration
+}
+
+func (c *cachedOptions) expired() bool {
+	return time.Since(c.fetchedAt) > c.ttl
+}
+
+// NewClient is the factory function for Client.
+func NewClient() *Client {
+	return &Client{options: make(map[string]*cachedOptions)}
+}
+
+// Do sends req to its URL's ICAP server and returns the parsed response.
+// If a cached OPTIONS response is available for req.URL (see Options),
+// Do negotiates on req's behalf: it enables a preview sized from the
+// server's advertised Preview, adds an "Allow: 204" header when the
+// server supports it and a preview is in effect, and skips the encapsulated body entirely when the
+// HTTP message's file extension is on the server's Transfer-Ignore list.
+// Negotiation can turn on a preview, so Do drives the same
+// continue/finish flow as DoPreview whenever req.previewSet ends up
+// true - otherwise a server answering the preview with 100 Continue
+// would have that interim response handed back as if it were final.
+func (c *Client) Do(req *Request) (*Response, error) {
+	if req.Method != MethodOPTIONS {
+		c.negotiate(req)
+	}
+
+	if req.previewSet {
+		return c.doPreview(req)
+	}
+
+	resp, err := c.do(req.context(), req)
+	if err != nil {
+		return nil, err
+	}
+
+	// 204 No Content means the server chose not to modify the message;
+	// hand the caller back exactly what it sent, so it doesn't need to
+	// keep a parallel copy around just for this case.
+	if resp.StatusCode == http.StatusNoContent {
+		resp.HTTPRequest = req.HTTPRequest
+		resp.HTTPResponse = req.HTTPResponse
+	}
+
+	// 206 Partial Content carries only the modified byte ranges of the
+	// body; resp.ContentRange / resp.ModifiedBody (parsed by
+	// readResponse) are there for the caller to splice into its own copy
+	// of the body.
+
+	return resp, nil
+}
+
+func (c *Client) do(ctx context.Context, req *Request) (*Response, error) {
+	conn, stopWatch, err := c.dial(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer stopWatch()
+
+	if _, err := req.WriteTo(conn); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	resp, err := readResponse(conn)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// dial opens the TCP connection to req's ICAP server and arms it with
+// watchContext so a canceled ctx unblocks any in-flight Read/Write. The
+// returned stop func must be called once the caller is done with conn.
+func (c *Client) dial(ctx context.Context, req *Request) (net.Conn, func(), error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", req.URL.Host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return conn, watchContext(ctx, conn), nil
+}
+
+// DoPreview sends req, which must have a preview window enabled via
+// Request.SetPreview, and drives the two-phase preview flow to
+// completion: if the whole body fit in the preview (see
+// Request.PreviewFitsBody), the server's response to that single write
+// is final. Otherwise it reads the server's interim response; on 204 it
+// returns that response as-is (see Do), and on 100 Continue it sends
+// Request.RemainingBody as the rest of the chunked body and returns the
+// server's final response.
+func (c *Client) DoPreview(req *Request) (*Response, error) {
+	if !req.previewSet {
+		return nil, fmt.Errorf("DoPreview requires a preview to be set via Request.SetPreview")
+	}
+
+	return c.doPreview(req)
+}
+
+// doPreview is the shared implementation behind DoPreview and Do (once
+// negotiation has enabled a preview on req); it assumes req.previewSet.
+func (c *Client) doPreview(req *Request) (*Response, error) {
+	ctx := req.context()
+
+	conn, stopWatch, err := c.dial(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer stopWatch()
+
+	if _, err := req.WriteTo(conn); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	interim, err := readResponse(conn)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	// Anything other than 100 Continue is the server's final answer: it
+	// decided from the preview alone (e.g. 204 No Content, or a modified
+	// message it's prepared to send in full) and there is no more data
+	// for the client to send on this connection.
+	if interim.StatusCode != http.StatusContinue {
+		if interim.StatusCode == http.StatusNoContent {
+			interim.HTTPRequest = req.HTTPRequest
+			interim.HTTPResponse = req.HTTPResponse
+		}
+		return interim, nil
+	}
+
+	if _, err := writeChunkedBody(conn, req.RemainingBody()); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if _, err := io.WriteString(conn, "0"+CRLF+CRLF); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	final, err := readResponse(conn)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	if final.StatusCode == http.StatusNoContent {
+		final.HTTPRequest = req.HTTPRequest
+		final.HTTPResponse = req.HTTPResponse
+	}
+
+	return final, nil
+}
+
+// watchContext arms conn's deadline to the current time as soon as ctx is
+// done, which unblocks any Read/Write already in flight on conn (used to
+// abort a stuck ICAP dialog, e.g. a server that hangs mid-scan on a large
+// file). The returned stop func must be called once the caller is done
+// with conn so the watcher goroutine doesn't fire a deadline on a
+// connection that's about to be reused or closed for unrelated reasons.
+func watchContext(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// Options issues an ICAP OPTIONS request against urlStr and caches the
+// result for the duration of the server-advertised Options-TTL (see
+// https://datatracker.ietf.org/doc/html/rfc3507#section-4.10.2). A call
+// within that window returns the cached value without a round trip.
+func (c *Client) Options(ctx context.Context, urlStr string) (*OptionsResponse, error) {
+	c.mu.Lock()
+	cached, ok := c.options[urlStr]
+	c.mu.Unlock()
+	if ok && !cached.expired() {
+		return cached.resp, nil
+	}
+
+	optReq, err := NewOptionsRequest(urlStr)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(ctx, optReq)
+	if err != nil {
+		return nil, err
+	}
+
+	optResp := parseOptionsResponse(resp)
+
+	ttl := optResp.OptionsTTL
+	if ttl <= 0 {
+		ttl = DefaultOptionsTTL
+	}
+
+	c.mu.Lock()
+	c.options[urlStr] = &cachedOptions{resp: optResp, fetchedAt: time.Now(), ttl: ttl}
+	c.mu.Unlock()
+
+	return optResp, nil
+}
+
+// negotiate applies a cached OPTIONS response for req.URL to req, if one
+// is available and still fresh.
+func (c *Client) negotiate(req *Request) {
+	c.mu.Lock()
+	cached, ok := c.options[req.URL.String()]
+	c.mu.Unlock()
+	if !ok || cached.expired() {
+		return
+	}
+
+	opt := cached.resp
+
+	if opt.Preview > 0 && !req.previewSet {
+		req.SetPreview(opt.Preview)
+	}
+
+	// writeTo refuses Allow204 without a preview (RFC 3507 section 4.6),
+	// so only turn it on here when negotiation actually set one.
+	if opt.Allow204 && req.previewSet {
+		req.Allow204 = true
+	}
+
+	if ext := transferExtension(req); ext != "" && containsFold(opt.TransferIgnore, ext) {
+		if req.HTTPRequest != nil {
+			req.HTTPRequest.Body = nil
+			req.HTTPRequest.ContentLength = 0
+			req.HTTPRequest.Header.Del("Content-Length")
+		}
+		if req.HTTPResponse != nil {
+			req.HTTPResponse.Body = nil
+			req.HTTPResponse.ContentLength = 0
+			req.HTTPResponse.Header.Del("Content-Length")
+		}
+	}
+}
+
+// transferExtension returns the file extension (without the leading dot)
+// of the URL of whichever encapsulated HTTP message req carries, or "" if
+// none can be determined.
+func transferExtension(req *Request) string {
+	var u *url.URL
+	switch {
+	case req.HTTPRequest != nil:
+		u = req.HTTPRequest.URL
+	case req.HTTPResponse != nil && req.HTTPResponse.Request != nil:
+		u = req.HTTPResponse.Request.URL
+	}
+
+	if u == nil {
+		return ""
+	}
+
+	if ext := path.Ext(u.Path); ext != "" {
+		return strings.TrimPrefix(ext, ".")
+	}
+
+	return ""
+}
+
+// containsFold reports whether v is in list, ignoring case and any
+// leading dot on the list entries.
+func containsFold(list []string, v string) bool {
+	for _, item := range list {
+		if strings.EqualFold(strings.TrimPrefix(item, "."), v) {
+			return true
+		}
+	}
+	return false
+}
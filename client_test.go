@@ -0,0 +1,373 @@
+package icapclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDoHonorsContextCancellation(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan struct{})
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		close(accepted)
+		// Accept the connection but never respond, simulating a server
+		// that hangs mid-scan on a large file.
+		time.Sleep(time.Second)
+	}()
+
+	httpReq, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if err != nil {
+		t.Fatalf("new http request: %v", err)
+	}
+
+	req, err := NewRequest(MethodREQMOD, "icap://"+ln.Addr().String()+"/avscan", httpReq, nil)
+	if err != nil {
+		t.Fatalf("new icap request: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req.SetContext(ctx)
+
+	start := time.Now()
+	_, err = NewClient().Do(req)
+	elapsed := time.Since(start)
+
+	<-accepted
+
+	if err == nil {
+		t.Fatal("expected an error once the context expired, got nil")
+	}
+	if elapsed > time.Second {
+		t.Errorf("Do took %s, expected it to abort promptly once the context expired", elapsed)
+	}
+}
+
+func TestNegotiateGatesAllow204OnPreview(t *testing.T) {
+	u, err := url.Parse("icap://icap.example.com/avscan")
+	if err != nil {
+		t.Fatalf("parse url: %v", err)
+	}
+
+	t.Run("no preview advertised", func(t *testing.T) {
+		c := &Client{options: map[string]*cachedOptions{
+			u.String(): {
+				resp:      &OptionsResponse{Allow204: true},
+				fetchedAt: time.Now(),
+				ttl:       time.Minute,
+			},
+		}}
+
+		req := &Request{URL: u}
+		c.negotiate(req)
+
+		if req.Allow204 {
+			t.Error("expected Allow204 to stay false without a negotiated preview")
+		}
+	})
+
+	t.Run("preview advertised", func(t *testing.T) {
+		c := &Client{options: map[string]*cachedOptions{
+			u.String(): {
+				resp:      &OptionsResponse{Allow204: true, Preview: 1024},
+				fetchedAt: time.Now(),
+				ttl:       time.Minute,
+			},
+		}}
+
+		req := &Request{URL: u}
+		c.negotiate(req)
+
+		if !req.previewSet || req.PreviewBytes != 1024 {
+			t.Errorf("expected a 1024-byte preview to be negotiated, got previewSet=%v PreviewBytes=%d", req.previewSet, req.PreviewBytes)
+		}
+		if !req.Allow204 {
+			t.Error("expected Allow204 to be set once a preview was negotiated")
+		}
+	})
+}
+
+// TestNegotiateSkipsTransferIgnoreBody verifies the fix for negotiate's
+// Transfer-Ignore handling: clearing Body must come with clearing
+// ContentLength and the Content-Length header, or writeTo either
+// hard-errors (REQMOD) or emits a malformed wire message (RESPMOD).
+func TestNegotiateSkipsTransferIgnoreBody(t *testing.T) {
+	u, err := url.Parse("icap://icap.example.com/avscan")
+	if err != nil {
+		t.Fatalf("parse url: %v", err)
+	}
+
+	c := &Client{options: map[string]*cachedOptions{
+		u.String(): {
+			resp:      &OptionsResponse{TransferIgnore: []string{"jpg"}},
+			fetchedAt: time.Now(),
+			ttl:       time.Minute,
+		},
+	}}
+
+	httpReq, err := http.NewRequest(http.MethodPut, "http://example.com/photo.jpg", strings.NewReader("binary jpeg data"))
+	if err != nil {
+		t.Fatalf("new http request: %v", err)
+	}
+	httpReq.ContentLength = 16
+	httpReq.Header.Set("Content-Length", "16")
+
+	req := &Request{URL: u, HTTPRequest: httpReq}
+	c.negotiate(req)
+
+	if req.HTTPRequest.Body != nil {
+		t.Error("expected HTTPRequest.Body to be cleared for a Transfer-Ignore match")
+	}
+	if req.HTTPRequest.ContentLength != 0 {
+		t.Errorf("ContentLength = %d, want 0", req.HTTPRequest.ContentLength)
+	}
+	if req.HTTPRequest.Header.Get("Content-Length") != "" {
+		t.Errorf("Content-Length header = %q, want empty", req.HTTPRequest.Header.Get("Content-Length"))
+	}
+}
+
+func TestNegotiateLeavesNonMatchingExtensionAlone(t *testing.T) {
+	u, err := url.Parse("icap://icap.example.com/avscan")
+	if err != nil {
+		t.Fatalf("parse url: %v", err)
+	}
+
+	c := &Client{options: map[string]*cachedOptions{
+		u.String(): {
+			resp:      &OptionsResponse{TransferIgnore: []string{"jpg"}},
+			fetchedAt: time.Now(),
+			ttl:       time.Minute,
+		},
+	}}
+
+	httpReq, err := http.NewRequest(http.MethodPut, "http://example.com/report.html", strings.NewReader("<html></html>"))
+	if err != nil {
+		t.Fatalf("new http request: %v", err)
+	}
+
+	req := &Request{URL: u, HTTPRequest: httpReq}
+	c.negotiate(req)
+
+	if req.HTTPRequest.Body == nil {
+		t.Error("expected HTTPRequest.Body to survive negotiation for a non-matching extension")
+	}
+}
+
+func TestTransferExtension(t *testing.T) {
+	cases := []struct {
+		name string
+		req  *Request
+		want string
+	}{
+		{"request URL with extension", &Request{HTTPRequest: &http.Request{URL: mustParseURL(t, "http://example.com/file.exe")}}, "exe"},
+		{"request URL without extension", &Request{HTTPRequest: &http.Request{URL: mustParseURL(t, "http://example.com/file")}}, ""},
+		{"no encapsulated message", &Request{}, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := transferExtension(c.req); got != c.want {
+				t.Errorf("transferExtension() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("parse url: %v", err)
+	}
+	return u
+}
+
+func TestContainsFold(t *testing.T) {
+	list := []string{"jpg", ".MP3", "Html"}
+
+	cases := []struct {
+		v    string
+		want bool
+	}{
+		{"jpg", true},
+		{"JPG", true},
+		{"mp3", true},
+		{"html", true},
+		{"exe", false},
+	}
+
+	for _, c := range cases {
+		if got := containsFold(list, c.v); got != c.want {
+			t.Errorf("containsFold(%v, %q) = %v, want %v", list, c.v, got, c.want)
+		}
+	}
+}
+
+// drainUntil reads from br byte by byte until the accumulated tail
+// matches marker, failing the (sub)test it runs under otherwise. It is
+// meant to be called from the fake-server goroutine, so it only ever
+// calls the goroutine-safe t.Errorf - never Fatalf.
+func drainUntil(t *testing.T, br *bufio.Reader, marker string) bool {
+	t.Helper()
+
+	var buf bytes.Buffer
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			t.Errorf("draining connection up to %q: %v", marker, err)
+			return false
+		}
+		buf.WriteByte(b)
+		if strings.HasSuffix(buf.String(), marker) {
+			return true
+		}
+	}
+}
+
+func newTestPreviewRequest(t *testing.T, addr string) *Request {
+	t.Helper()
+
+	httpReq, err := http.NewRequest(http.MethodPost, "http://example.com/upload", strings.NewReader("this body is longer than the preview window"))
+	if err != nil {
+		t.Fatalf("new http request: %v", err)
+	}
+
+	req, err := NewRequest(MethodREQMOD, "icap://"+addr+"/avscan", httpReq, nil)
+	if err != nil {
+		t.Fatalf("new icap request: %v", err)
+	}
+	req.SetPreview(4)
+
+	return req
+}
+
+// runFakeICAPServer accepts a single connection on an ephemeral port and
+// runs handle against it, returning the address to dial and a done
+// channel that's closed once handle returns.
+func runFakeICAPServer(t *testing.T, handle func(t *testing.T, conn net.Conn)) (addr string, done <-chan struct{}) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		handle(t, conn)
+	}()
+
+	return ln.Addr().String(), doneCh
+}
+
+func TestDoPreviewImmediateNoContent(t *testing.T) {
+	addr, done := runFakeICAPServer(t, func(t *testing.T, conn net.Conn) {
+		if !drainUntil(t, bufio.NewReader(conn), "0\r\n\r\n") {
+			return
+		}
+		io.WriteString(conn, "ICAP/1.0 204 No Content\r\nISTag: \"x\"\r\n\r\n")
+	})
+
+	req := newTestPreviewRequest(t, addr)
+
+	resp, err := NewClient().DoPreview(req)
+	if err != nil {
+		t.Fatalf("DoPreview: %v", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got status %d, want 204", resp.StatusCode)
+	}
+	if resp.HTTPRequest != req.HTTPRequest {
+		t.Error("expected the 204 response to carry the original HTTPRequest through")
+	}
+
+	<-done
+}
+
+// TestDoPreviewImmediateFinal guards against DoPreview treating any
+// non-100 interim status as a 100 Continue: a server that decides from
+// the preview alone and answers with a final 200 must not have the rest
+// of the body sent to it, and its 200 must be returned as-is rather than
+// the client hanging for a second response that will never arrive.
+func TestDoPreviewImmediateFinal(t *testing.T) {
+	addr, done := runFakeICAPServer(t, func(t *testing.T, conn net.Conn) {
+		br := bufio.NewReader(conn)
+		if !drainUntil(t, br, "0\r\n\r\n") {
+			return
+		}
+		io.WriteString(conn, "ICAP/1.0 200 OK\r\nISTag: \"x\"\r\n\r\n")
+
+		// Nothing else should arrive: the client already has its final
+		// answer and must not stream the remaining body.
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := br.ReadByte(); err == nil {
+			t.Error("client sent more data after a non-continue final response")
+		}
+	})
+
+	req := newTestPreviewRequest(t, addr)
+
+	resp, err := NewClient().DoPreview(req)
+	if err != nil {
+		t.Fatalf("DoPreview: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want 200", resp.StatusCode)
+	}
+
+	<-done
+}
+
+func TestDoPreviewContinueThenFinal(t *testing.T) {
+	addr, done := runFakeICAPServer(t, func(t *testing.T, conn net.Conn) {
+		br := bufio.NewReader(conn)
+		if !drainUntil(t, br, "0\r\n\r\n") {
+			return
+		}
+		io.WriteString(conn, "ICAP/1.0 100 Continue\r\n\r\n")
+
+		if !drainUntil(t, br, "0\r\n\r\n") {
+			return
+		}
+		io.WriteString(conn, "ICAP/1.0 200 OK\r\nISTag: \"x\"\r\n\r\n")
+	})
+
+	req := newTestPreviewRequest(t, addr)
+
+	resp, err := NewClient().DoPreview(req)
+	if err != nil {
+		t.Fatalf("DoPreview: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want 200", resp.StatusCode)
+	}
+
+	<-done
+}
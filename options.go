@@ -0,0 +1,99 @@
+package icapclient
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OptionsResponse represents the parsed result of an ICAP OPTIONS
+// request, as defined by https://datatracker.ietf.org/doc/html/rfc3507#section-4.10.
+type OptionsResponse struct {
+	Methods          []string
+	Preview          int
+	TransferPreview  []string
+	TransferIgnore   []string
+	TransferComplete []string
+	MaxConnections   int
+	OptionsTTL       time.Duration
+	Allow204         bool
+	ISTag            string
+	Header           http.Header
+}
+
+// NewOptionsRequest is the factory function for an ICAP OPTIONS Request.
+// OPTIONS carries no encapsulated HTTP request or response, so
+// DumpRequest emits it with "Encapsulated: null-body=0".
+func NewOptionsRequest(urlStr string) (*Request, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Request{
+		Method: MethodOPTIONS,
+		URL:    u,
+		Header: make(http.Header),
+	}, nil
+}
+
+// parseOptionsResponse extracts the capability fields a client needs for
+// negotiation out of the headers of an ICAP OPTIONS response.
+func parseOptionsResponse(resp *Response) *OptionsResponse {
+	opt := &OptionsResponse{
+		Header: resp.Header,
+		ISTag:  resp.Header.Get("ISTag"),
+	}
+
+	if methods := resp.Header.Get("Methods"); methods != "" {
+		opt.Methods = splitCSV(methods)
+	}
+
+	if preview := resp.Header.Get("Preview"); preview != "" {
+		if n, err := strconv.Atoi(strings.TrimSpace(preview)); err == nil {
+			opt.Preview = n
+		}
+	}
+
+	opt.TransferPreview = splitCSV(resp.Header.Get("Transfer-Preview"))
+	opt.TransferIgnore = splitCSV(resp.Header.Get("Transfer-Ignore"))
+	opt.TransferComplete = splitCSV(resp.Header.Get("Transfer-Complete"))
+
+	if mc := resp.Header.Get("Max-Connections"); mc != "" {
+		if n, err := strconv.Atoi(strings.TrimSpace(mc)); err == nil {
+			opt.MaxConnections = n
+		}
+	}
+
+	if ttl := resp.Header.Get("Options-TTL"); ttl != "" {
+		if n, err := strconv.Atoi(strings.TrimSpace(ttl)); err == nil {
+			opt.OptionsTTL = time.Duration(n) * time.Second
+		}
+	}
+
+	for _, allow := range splitCSV(resp.Header.Get("Allow")) {
+		if allow == "204" {
+			opt.Allow204 = true
+		}
+	}
+
+	return opt
+}
+
+// splitCSV splits a comma-separated header value into its trimmed parts,
+// returning nil for an empty value.
+func splitCSV(v string) []string {
+	if v == "" {
+		return nil
+	}
+
+	parts := strings.Split(v, ",")
+	out := make([]string, 0, len(parts))
+	for _, p := range parts {
+		out = append(out, strings.TrimSpace(p))
+	}
+
+	return out
+}
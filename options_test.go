@@ -0,0 +1,108 @@
+package icapclient
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseOptionsResponse(t *testing.T) {
+	resp := &Response{Header: http.Header{
+		"Methods":           {"REQMOD, RESPMOD"},
+		"Preview":           {"1024"},
+		"Transfer-Preview":  {"*"},
+		"Transfer-Ignore":   {"jpg, mp3"},
+		"Transfer-Complete": {"html"},
+		"Max-Connections":   {"100"},
+		"Options-Ttl":       {"3600"},
+		"Allow":             {"204"},
+		"Istag":             {`"xyz"`},
+	}}
+
+	opt := parseOptionsResponse(resp)
+
+	if got, want := opt.Methods, []string{"REQMOD", "RESPMOD"}; !equalStrings(got, want) {
+		t.Errorf("Methods = %v, want %v", got, want)
+	}
+	if opt.Preview != 1024 {
+		t.Errorf("Preview = %d, want 1024", opt.Preview)
+	}
+	if got, want := opt.TransferIgnore, []string{"jpg", "mp3"}; !equalStrings(got, want) {
+		t.Errorf("TransferIgnore = %v, want %v", got, want)
+	}
+	if opt.MaxConnections != 100 {
+		t.Errorf("MaxConnections = %d, want 100", opt.MaxConnections)
+	}
+	if opt.OptionsTTL != time.Hour {
+		t.Errorf("OptionsTTL = %s, want 1h", opt.OptionsTTL)
+	}
+	if !opt.Allow204 {
+		t.Error("Allow204 = false, want true")
+	}
+	if opt.ISTag != `"xyz"` {
+		t.Errorf("ISTag = %q, want %q", opt.ISTag, `"xyz"`)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestClientOptionsCachesUntilTTLExpires drives a fake ICAP server that
+// counts how many OPTIONS requests it receives, and checks that Options
+// reuses a fresh (not yet expired) cache entry without redialing.
+func TestClientOptionsCachesUntilTTLExpires(t *testing.T) {
+	requests := make(chan struct{}, 2)
+
+	addr, done := runFakeICAPServer(t, func(t *testing.T, conn net.Conn) {
+		br := bufio.NewReader(conn)
+		if !drainUntil(t, br, "\r\n\r\n") {
+			return
+		}
+		requests <- struct{}{}
+		io.WriteString(conn, "ICAP/1.0 200 OK\r\nMethods: REQMOD\r\nPreview: 512\r\nOptions-TTL: 3600\r\nISTag: \"x\"\r\n\r\n")
+	})
+	defer func() { <-done }()
+
+	c := NewClient()
+	url := "icap://" + addr + "/avscan"
+
+	first, err := c.Options(context.Background(), url)
+	if err != nil {
+		t.Fatalf("Options: %v", err)
+	}
+	if first.Preview != 512 {
+		t.Fatalf("Preview = %d, want 512", first.Preview)
+	}
+
+	second, err := c.Options(context.Background(), url)
+	if err != nil {
+		t.Fatalf("Options (cached): %v", err)
+	}
+	if second != first {
+		t.Error("expected the second call to return the cached OptionsResponse without redialing")
+	}
+
+	select {
+	case <-requests:
+	case <-time.After(time.Second):
+		t.Fatal("fake server never saw the first OPTIONS request")
+	}
+	select {
+	case <-requests:
+		t.Fatal("fake server saw a second OPTIONS request despite a fresh cache entry")
+	default:
+	}
+}
@@ -1,24 +1,48 @@
 package icapclient
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strings"
 )
 
+// streamChunkSize is the buffer size used when streaming an encapsulated
+// HTTP body that falls outside of the preview window. It bounds the
+// amount of body data held in memory at any one time regardless of the
+// total body size.
+const streamChunkSize = 32 * 1024
+
 // Request represents the icap client request data
 type Request struct {
-	Method                string
-	URL                   *url.URL
-	Header                http.Header
-	HTTPRequest           *http.Request
-	HTTPResponse          *http.Response
-	ChunkLength           int
-	PreviewBytes          int
-	ctx                   *context.Context
+	Method       string
+	URL          *url.URL
+	Header       http.Header
+	HTTPRequest  *http.Request
+	HTTPResponse *http.Response
+	ChunkLength  int
+	PreviewBytes int
+
+	// Allow204 tells the server that the client accepts a 204 No Content
+	// response in place of a full modified message, meaning the original
+	// HTTP request/response can be reused as-is. Outside of a preview
+	// this requires the server to buffer the whole body before deciding
+	// (RFC 3507 section 4.6), so WriteTo refuses to send it with an
+	// encapsulated body but no preview.
+	Allow204 bool
+
+	// Allow206 tells the server that the client can accept a 206
+	// Partial Content response carrying only the modified byte ranges
+	// of the body, which it splices into its own copy. It is only
+	// meaningful alongside Allow204.
+	Allow206 bool
+
+	ctx                   context.Context
 	previewSet            bool
 	bodyFittedInPreview   bool
 	remainingPreviewBytes []byte
@@ -76,128 +100,364 @@ func NewRequest(method, urlStr string, httpReq *http.Request, httpResp *http.Res
 }
 
 // DumpRequest returns the given request in its ICAP/1.x wire
-// representation.
+// representation. It is implemented in terms of WriteTo and is kept for
+// callers that want the whole message as a single byte slice; for large
+// encapsulated bodies prefer WriteTo, which streams the body instead of
+// buffering it.
 func DumpRequest(req *Request, setAbsoluteUrl bool) ([]byte, error) {
+	var buf bytes.Buffer
 
-	// Making the ICAP message block
+	if _, err := req.writeTo(&buf, setAbsoluteUrl); err != nil {
+		return nil, err
+	}
 
-	reqStr := fmt.Sprintf("%s %s %s%s", req.Method, req.URL.String(), ICAPVersion, CRLF)
+	return buf.Bytes(), nil
+}
 
-	for headerName, vals := range req.Header {
-		for _, val := range vals {
-			reqStr += fmt.Sprintf("%s: %s%s", headerName, val, CRLF)
+// WriteTo writes the ICAP request, including the encapsulated HTTP
+// request/response, to w. Unlike DumpRequest it never holds the full
+// encapsulated body in memory: the ICAP and HTTP header blocks are
+// rendered into a small buffer (to compute the Encapsulated offsets),
+// and the body is then streamed directly from r.HTTPRequest.Body /
+// r.HTTPResponse.Body through a chunked-transfer writer. When a preview
+// has been requested via r.PreviewBytes, only the first PreviewBytes of
+// the body are sent up front; the remainder is left for the caller to
+// send after a 100 Continue (see RemainingBody).
+func (r *Request) WriteTo(w io.Writer) (int64, error) {
+	return r.writeTo(w, false)
+}
+
+func (r *Request) writeTo(w io.Writer, setAbsoluteUrl bool) (int64, error) {
+	var written int64
+
+	var reqHeader string
+	var reqBody io.Reader
+	if r.HTTPRequest != nil {
+		var err error
+		reqHeader, err = dumpHTTPRequestHeader(r.HTTPRequest, setAbsoluteUrl)
+		if err != nil {
+			return written, err
+		}
+		reqBody = r.HTTPRequest.Body
+	}
+
+	var respHeader string
+	var respBody io.Reader
+	if r.HTTPResponse != nil {
+		var err error
+		respHeader, err = dumpHTTPResponseHeader(r.HTTPResponse)
+		if err != nil {
+			return written, err
 		}
+		respBody = r.HTTPResponse.Body
+	}
+
+	// RESPMOD only ever encapsulates the original HTTP request's headers,
+	// never its body (see https://datatracker.ietf.org/doc/html/rfc3507#section-4.9.1).
+	if r.Method != MethodREQMOD {
+		reqBody = nil
 	}
 
-	reqStr += "Encapsulated: %s" + CRLF // will populate the Encapsulated header value after making the http Request & Response messages
-	reqStr += CRLF
+	if r.Allow204 && !r.previewSet && (reqBody != nil || respBody != nil) {
+		return written, fmt.Errorf("Allow204 requires a preview to be set (see RFC 3507 section 4.6): the server would otherwise have to buffer the whole body to decide")
+	}
 
-	// Making the HTTP Request message block
+	encapsulated := r.buildEncapsulatedHeaderValue(reqHeader, respHeader, reqBody, respBody)
 
-	httpReqStr := ""
-	if req.HTTPRequest != nil {
-		b, err := httputil.DumpRequestOut(req.HTTPRequest, true)
+	n, err := w.Write(r.dumpICAPHeader(encapsulated))
+	written += int64(n)
+	if err != nil {
+		return written, err
+	}
 
+	if reqHeader != "" {
+		bn, err := io.WriteString(w, reqHeader)
+		written += int64(bn)
 		if err != nil {
-			return nil, err
+			return written, err
 		}
+	}
 
-		httpReqStr = string(b)
-		if setAbsoluteUrl {
-			partsHttp := strings.SplitN(httpReqStr, "\n", 2)
-			if len(partsHttp) < 2 {
-				return []byte{}, fmt.Errorf("Failed to parse dumped HTTPRequest: %s", httpReqStr)
-			}
-			headerLineParts := strings.Split(partsHttp[0], " ")
-			if len(headerLineParts) != 3 {
-				return []byte{}, fmt.Errorf("Incorrect HTTP header line: %s", partsHttp[0])
-			}
-			newHeaderLine := headerLineParts[0] + " " + req.HTTPRequest.URL.String() + " " + headerLineParts[2]
-			httpReqStr = newHeaderLine + "\n" + partsHttp[1]
+	if reqBody != nil {
+		fitted, bn, err := r.streamEncapsulatedBody(w, reqBody)
+		written += bn
+		if err != nil {
+			return written, err
 		}
+		r.bodyFittedInPreview = fitted
+	}
 
-		if req.Method == MethodREQMOD {
-			if req.previewSet {
-				parsePreviewBodyBytes(&httpReqStr, req.PreviewBytes)
-			}
+	if respHeader != "" {
+		bn, err := io.WriteString(w, respHeader)
+		written += int64(bn)
+		if err != nil {
+			return written, err
+		}
+	}
 
-			if !bodyAlreadyChunked(httpReqStr) {
-				headerStr, bodyStr, ok := splitBodyAndHeader(httpReqStr)
-				if ok {
-					addHexaBodyByteNotations(&bodyStr)
-					mergeHeaderAndBody(&httpReqStr, headerStr, bodyStr)
-				}
-			}
+	if respBody != nil {
+		fitted, bn, err := r.streamEncapsulatedBody(w, respBody)
+		written += bn
+		if err != nil {
+			return written, err
+		}
+		r.bodyFittedInPreview = fitted
+	}
 
-		} else { // In case of RESPMOD we send only header (see https://datatracker.ietf.org/doc/html/rfc3507#section-4.9.1)
-			headerStr, _, ok := splitBodyAndHeader(httpReqStr)
-			if ok {
-				httpReqStr = headerStr
-			}
+	return written, nil
+}
+
+// dumpICAPHeader renders the ICAP request line and headers, including the
+// Allow and Encapsulated headers.
+func (r *Request) dumpICAPHeader(encapsulated string) []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "%s %s %s%s", r.Method, r.URL.String(), ICAPVersion, CRLF)
+
+	for headerName, vals := range r.Header {
+		for _, val := range vals {
+			fmt.Fprintf(&buf, "%s: %s%s", headerName, val, CRLF)
 		}
+	}
 
-		if httpReqStr != "" { // if the HTTP Request message block doesn't end with a \r\n\r\n, then going to add one by force for better calculation of byte offsets
-			for !strings.HasSuffix(httpReqStr, DoubleCRLF) {
-				httpReqStr = trimAllSuffixes(httpReqStr, CRLF)
-				httpReqStr += DoubleCRLF
-			}
+	if r.Allow204 {
+		allow := "204"
+		if r.Allow206 {
+			allow = "204, 206"
 		}
+		fmt.Fprintf(&buf, "Allow: %s%s", allow, CRLF)
+	}
 
+	if encpVal := r.Header.Get(EncapsulatedHeader); encpVal != "" {
+		fmt.Fprintf(&buf, "%s: %s%s", EncapsulatedHeader, encpVal, CRLF)
+	} else {
+		fmt.Fprintf(&buf, "%s: %s%s", EncapsulatedHeader, encapsulated, CRLF)
 	}
 
-	// Making the HTTP Response message block
+	buf.WriteString(CRLF)
+
+	return buf.Bytes()
+}
+
+// buildEncapsulatedHeaderValue computes the Encapsulated header value from
+// the *sizes* of the already-serialized header blocks, rather than by
+// rendering the encapsulated parts first.
+func (r *Request) buildEncapsulatedHeaderValue(reqHeader, respHeader string, reqBody, respBody io.Reader) string {
+	var parts []string
+	offset := 0
+
+	if reqHeader != "" {
+		parts = append(parts, fmt.Sprintf("req-hdr=%d", offset))
+		offset += len(reqHeader)
+	}
 
-	httpRespStr := ""
-	if req.HTTPResponse != nil {
-		b, err := httputil.DumpResponse(req.HTTPResponse, true)
+	if respHeader != "" {
+		parts = append(parts, fmt.Sprintf("res-hdr=%d", offset))
+		offset += len(respHeader)
+	}
 
+	switch {
+	case respBody != nil:
+		parts = append(parts, fmt.Sprintf("res-body=%d", offset))
+	case reqBody != nil:
+		parts = append(parts, fmt.Sprintf("req-body=%d", offset))
+	default:
+		parts = append(parts, fmt.Sprintf("null-body=%d", offset))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// streamEncapsulatedBody writes body to w using HTTP chunked
+// transfer-coding, honoring r.PreviewBytes when a preview has been
+// requested. It returns whether the entire body fit inside the preview
+// window, the number of bytes written to w, and any error encountered.
+// When a preview does not consume the whole body, the bytes bufio already
+// pulled out of body are stashed in r.remainingPreviewBytes so a later
+// call to RemainingBody can replay them.
+func (r *Request) streamEncapsulatedBody(w io.Writer, body io.Reader) (bool, int64, error) {
+	if !r.previewSet {
+		written, err := writeChunkedBody(w, body)
 		if err != nil {
-			return nil, err
+			return false, written, err
 		}
+		n, err := io.WriteString(w, "0"+CRLF+CRLF)
+		return false, written + int64(n), err
+	}
+
+	var written int64
+
+	br := bufio.NewReaderSize(body, r.PreviewBytes+1)
 
-		httpRespStr += string(b)
+	preview := make([]byte, r.PreviewBytes)
+	read, err := io.ReadFull(br, preview)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, written, err
+	}
+	preview = preview[:read]
 
-		if req.previewSet {
-			parsePreviewBodyBytes(&httpRespStr, req.PreviewBytes)
+	if len(preview) > 0 {
+		n, err := writeChunk(w, preview)
+		written += n
+		if err != nil {
+			return false, written, err
 		}
+	}
+
+	if _, peekErr := br.Peek(1); peekErr != nil { // the whole body fit in the preview
+		n, err := io.WriteString(w, "0; ieof"+CRLF+CRLF)
+		return true, written + int64(n), err
+	}
+
+	buffered, _ := br.Peek(br.Buffered())
+	r.remainingPreviewBytes = append([]byte(nil), buffered...)
 
-		if !bodyAlreadyChunked(httpRespStr) {
-			headerStr, bodyStr, ok := splitBodyAndHeader(httpRespStr)
-			if ok {
-				addHexaBodyByteNotations(&bodyStr)
-				mergeHeaderAndBody(&httpRespStr, headerStr, bodyStr)
+	n, err := io.WriteString(w, "0"+CRLF+CRLF)
+	return false, written + int64(n), err
+}
+
+// writeChunkedBody copies body to w in streamChunkSize-sized HTTP chunks,
+// never holding more than one chunk's worth of body data in memory.
+func writeChunkedBody(w io.Writer, body io.Reader) (int64, error) {
+	var written int64
+	buf := make([]byte, streamChunkSize)
+
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			wn, err := writeChunk(w, buf[:n])
+			written += wn
+			if err != nil {
+				return written, err
 			}
 		}
-
-		if httpRespStr != "" && !strings.HasSuffix(httpRespStr, DoubleCRLF) { // if the HTTP Response message block doesn't end with a \r\n\r\n, then going to add one by force for better calculation of byte offsets
-			httpRespStr = trimAllSuffixes(httpRespStr, CRLF)
-			httpRespStr += DoubleCRLF
+		if readErr == io.EOF {
+			return written, nil
 		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
 
+// writeChunk writes p to w as a single HTTP chunk. An empty p is a no-op;
+// callers are responsible for writing the terminating zero-length chunk.
+func writeChunk(w io.Writer, p []byte) (int64, error) {
+	if len(p) == 0 {
+		return 0, nil
 	}
 
-	if encpVal := req.Header.Get(EncapsulatedHeader); encpVal != "" {
-		reqStr = fmt.Sprintf(reqStr, encpVal)
-	} else {
-		//populating the Encapsulated header of the ICAP message portion
-		setEncapsulatedHeaderValue(&reqStr, httpReqStr, httpRespStr)
+	var written int64
+
+	n, err := fmt.Fprintf(w, "%x"+CRLF, len(p))
+	written += int64(n)
+	if err != nil {
+		return written, err
 	}
 
-	// determining if the http message needs the full body fitted in the preview portion indicator or not
-	if httpRespStr != "" && req.previewSet && req.bodyFittedInPreview {
-		addFullBodyInPreviewIndicator(&httpRespStr)
+	bn, err := w.Write(p)
+	written += int64(bn)
+	if err != nil {
+		return written, err
 	}
 
-	if req.Method == MethodREQMOD && req.previewSet && req.bodyFittedInPreview {
-		addFullBodyInPreviewIndicator(&httpReqStr)
+	cn, err := io.WriteString(w, CRLF)
+	written += int64(cn)
+	return written, err
+}
+
+// dumpHTTPRequestHeader renders just the header block of an HTTP request
+// (status line, headers, terminating CRLF CRLF), without its body.
+func dumpHTTPRequestHeader(req *http.Request, setAbsoluteUrl bool) (string, error) {
+	b, err := httputil.DumpRequestOut(req, false)
+	if err != nil {
+		return "", err
+	}
+
+	headerStr := string(b)
+
+	if setAbsoluteUrl {
+		parts := strings.SplitN(headerStr, "\n", 2)
+		if len(parts) < 2 {
+			return "", fmt.Errorf("Failed to parse dumped HTTPRequest: %s", headerStr)
+		}
+		lineParts := strings.Split(parts[0], " ")
+		if len(lineParts) != 3 {
+			return "", fmt.Errorf("Incorrect HTTP header line: %s", parts[0])
+		}
+		newHeaderLine := lineParts[0] + " " + req.URL.String() + " " + lineParts[2]
+		headerStr = newHeaderLine + "\n" + parts[1]
 	}
 
-	data := []byte(reqStr + httpReqStr + httpRespStr)
+	return headerStr, nil
+}
+
+// dumpHTTPResponseHeader renders just the header block of an HTTP
+// response (status line, headers, terminating CRLF CRLF), without its
+// body.
+func dumpHTTPResponseHeader(resp *http.Response) (string, error) {
+	b, err := httputil.DumpResponse(resp, false)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
 
-	return data, nil
+// SetPreview enables the ICAP preview mechanism (RFC 3507 section 4.5):
+// WriteTo sends only the first n bytes of the encapsulated body up
+// front, and the caller is expected to drive the rest of the exchange
+// via Client.DoPreview.
+func (r *Request) SetPreview(n int) {
+	r.PreviewBytes = n
+	r.previewSet = true
 }
 
-// SetContext sets a context for the ICAP request
-func (r *Request) SetContext(ctx context.Context) { // TODO: make context take control over the whole operation
-	r.ctx = &ctx
+// PreviewFitsBody reports whether the entire encapsulated body fit
+// inside the preview window written by WriteTo, meaning there is
+// nothing left to send after the server's interim response.
+func (r *Request) PreviewFitsBody() bool {
+	return r.bodyFittedInPreview
+}
+
+// RemainingBody returns the part of the encapsulated body that WriteTo
+// has not yet sent: first the bytes bufio already pulled out of the
+// original reader while looking for the end of the preview
+// (remainingPreviewBytes), followed by whatever is left unread of
+// HTTPRequest.Body / HTTPResponse.Body. A caller that received a 100
+// Continue after a preview that didn't fit the whole body should send
+// this as the rest of the chunked body.
+func (r *Request) RemainingBody() io.Reader {
+	var body io.Reader
+	switch {
+	case r.Method == MethodREQMOD && r.HTTPRequest != nil:
+		body = r.HTTPRequest.Body
+	case r.HTTPResponse != nil:
+		body = r.HTTPResponse.Body
+	}
+
+	if len(r.remainingPreviewBytes) == 0 {
+		return body
+	}
+	if body == nil {
+		return bytes.NewReader(r.remainingPreviewBytes)
+	}
+	return io.MultiReader(bytes.NewReader(r.remainingPreviewBytes), body)
+}
+
+// SetContext sets a context for the ICAP request. Client.Do honors
+// ctx.Done() for the whole round trip: dialing, sending the preview and
+// the remainder of the body, and reading the final ICAP response all
+// abort as soon as ctx is canceled or its deadline passes.
+func (r *Request) SetContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
+// context returns the context set via SetContext, or context.Background
+// if none was set.
+func (r *Request) context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
 }
@@ -0,0 +1,100 @@
+package icapclient
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBuildEncapsulatedHeaderValue(t *testing.T) {
+	r := &Request{}
+	reqHdr := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	respHdr := "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\n"
+
+	cases := []struct {
+		name                    string
+		reqHdr, respHdr         string
+		hasReqBody, hasRespBody bool
+		want                    string
+	}{
+		{"no encapsulated parts", "", "", false, false, "null-body=0"},
+		{"request headers only", reqHdr, "", false, false, fmt.Sprintf("req-hdr=0, null-body=%d", len(reqHdr))},
+		{"request headers and body", reqHdr, "", true, false, fmt.Sprintf("req-hdr=0, req-body=%d", len(reqHdr))},
+		{
+			"request and response headers, response body",
+			reqHdr, respHdr, false, true,
+			fmt.Sprintf("req-hdr=0, res-hdr=%d, res-body=%d", len(reqHdr), len(reqHdr)+len(respHdr)),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var reqBody, respBody io.Reader
+			if c.hasReqBody {
+				reqBody = strings.NewReader("x")
+			}
+			if c.hasRespBody {
+				respBody = strings.NewReader("x")
+			}
+
+			got := r.buildEncapsulatedHeaderValue(c.reqHdr, c.respHdr, reqBody, respBody)
+			if got != c.want {
+				t.Errorf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestStreamEncapsulatedBodyPreviewFits(t *testing.T) {
+	r := &Request{}
+	r.SetPreview(10)
+
+	var buf bytes.Buffer
+	fitted, _, err := r.streamEncapsulatedBody(&buf, strings.NewReader("short"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !fitted {
+		t.Errorf("expected the body to fit within the preview")
+	}
+	if !strings.Contains(buf.String(), "0; ieof\r\n\r\n") {
+		t.Errorf("expected an ieof terminator, got %q", buf.String())
+	}
+}
+
+func TestStreamEncapsulatedBodyPreviewDoesNotFit(t *testing.T) {
+	body := "this body is longer than the preview window"
+
+	r := &Request{Method: MethodREQMOD, HTTPRequest: &http.Request{
+		Body: io.NopCloser(strings.NewReader(body)),
+	}}
+	r.SetPreview(4)
+
+	var buf bytes.Buffer
+	// streamEncapsulatedBody reads from the same HTTPRequest.Body that
+	// RemainingBody reads from below, mirroring how writeTo drives it.
+	fitted, _, err := r.streamEncapsulatedBody(&buf, r.HTTPRequest.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fitted {
+		t.Errorf("expected the body not to fit within the preview")
+	}
+	if strings.Contains(buf.String(), "ieof") {
+		t.Errorf("did not expect an ieof terminator, got %q", buf.String())
+	}
+	if !strings.HasSuffix(buf.String(), "0\r\n\r\n") {
+		t.Errorf("expected a plain zero-length chunk terminator, got %q", buf.String())
+	}
+
+	remaining, err := io.ReadAll(r.RemainingBody())
+	if err != nil {
+		t.Fatalf("reading RemainingBody: %v", err)
+	}
+	if string(remaining) != body[4:] {
+		t.Errorf("RemainingBody() = %q, want %q", remaining, body[4:])
+	}
+}
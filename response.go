@@ -0,0 +1,104 @@
+package icapclient
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// Response represents a parsed ICAP server response.
+type Response struct {
+	StatusCode int
+	Status     string
+	Header     http.Header
+	ISTag      string
+
+	// HTTPRequest and HTTPResponse are populated by Client.Do and
+	// Client.DoPreview when the server answers with 204 No Content: they
+	// are the HTTPRequest and HTTPResponse of the Request that was sent
+	// (the copies NewRequest made of what the caller passed in), handed
+	// back so the caller can reuse them as-is instead of keeping a
+	// parallel copy around just in case.
+	HTTPRequest  *http.Request
+	HTTPResponse *http.Response
+
+	// ContentRange and ModifiedBody are populated when the server
+	// answers with 206 Partial Content: ContentRange is the Content-Range
+	// header of the encapsulated HTTP message, and ModifiedBody is its
+	// body - the byte range the caller should splice into its own copy
+	// of the original body at that range.
+	ContentRange string
+	ModifiedBody io.Reader
+}
+
+// readResponse parses the ICAP status line and headers off r, plus the
+// encapsulated HTTP message carried by a 206 Partial Content response.
+func readResponse(r io.Reader) (*Response, error) {
+	br := bufio.NewReader(r)
+	tp := textproto.NewReader(br)
+
+	statusLine, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(statusLine, " ", 3)
+	if len(parts) < 3 {
+		return nil, fmt.Errorf("malformed ICAP status line: %s", statusLine)
+	}
+
+	code, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ICAP status code: %s", parts[1])
+	}
+
+	mimeHeader, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	header := http.Header(mimeHeader)
+
+	resp := &Response{
+		StatusCode: code,
+		Status:     parts[2],
+		Header:     header,
+		ISTag:      header.Get("ISTag"),
+	}
+
+	if resp.StatusCode == http.StatusPartialContent {
+		if err := readPartialContent(br, resp); err != nil {
+			return nil, err
+		}
+	}
+
+	return resp, nil
+}
+
+// readPartialContent reads the encapsulated HTTP response that follows a
+// 206 Partial Content ICAP response - its Content-Range header and its
+// body, the modified bytes the caller splices into the original body.
+func readPartialContent(br *bufio.Reader, resp *Response) error {
+	httpResp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return fmt.Errorf("reading encapsulated 206 response: %w", err)
+	}
+
+	// The connection is closed once Client.Do returns, so the modified
+	// bytes are read in full here rather than left streaming from it.
+	body, err := io.ReadAll(httpResp.Body)
+	httpResp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("reading encapsulated 206 body: %w", err)
+	}
+
+	resp.ContentRange = httpResp.Header.Get("Content-Range")
+	resp.ModifiedBody = bytes.NewReader(body)
+
+	return nil
+}
@@ -0,0 +1,43 @@
+package icapclient
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReadResponsePartialContent(t *testing.T) {
+	raw := "ICAP/1.0 206 Partial Content\r\n" +
+		"ISTag: \"abc123\"\r\n" +
+		"Encapsulated: res-hdr=0, res-body=58\r\n" +
+		"\r\n" +
+		"HTTP/1.1 200 OK\r\n" +
+		"Content-Range: bytes 100-109/500\r\n" +
+		"Content-Length: 4\r\n" +
+		"\r\n" +
+		"data"
+
+	resp, err := readResponse(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("readResponse: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("got status %d, want 206", resp.StatusCode)
+	}
+	if resp.ISTag != `"abc123"` {
+		t.Errorf("got ISTag %q, want %q", resp.ISTag, `"abc123"`)
+	}
+	if resp.ContentRange != "bytes 100-109/500" {
+		t.Errorf("got ContentRange %q, want %q", resp.ContentRange, "bytes 100-109/500")
+	}
+
+	body, err := io.ReadAll(resp.ModifiedBody)
+	if err != nil {
+		t.Fatalf("reading ModifiedBody: %v", err)
+	}
+	if string(body) != "data" {
+		t.Errorf("got ModifiedBody %q, want %q", body, "data")
+	}
+}